@@ -7,307 +7,379 @@
 package main
 
 import (
-	"compress/gzip" // Package gzip provides support for reading and writing GZIP format compressed files.
-	"flag"          // Package flag implements command-line flag parsing.
-	"fmt"           // Package fmt implements formatted I/O.
-	"io"            // Package io provides basic interfaces to I/O primitives.
-	"log"           // Package log implements a simple logging package.
-	"net"           // Package net provides a portable interface for network I/O.
-	"os"            // Package os provides a platform-independent interface to operating system functionality.
-	"runtime"       // Package runtime provides operations that interact with Go's runtime system.
-	"strings"       // Package strings implements simple functions to manipulate UTF-8 encoded strings.
-	"time"          // Package time provides functionality for measuring and displaying time.
+	"context"   // Package context drives the proxy's shutdown lifecycle and carries the route logger.
+	"flag"      // Package flag implements command-line flag parsing.
+	"fmt"       // Package fmt implements formatted I/O.
+	"log"       // Package log implements a simple logging package, used only before our own logger exists.
+	"net/http"  // Package net/http serves the optional Prometheus -metrics endpoint.
+	"os"        // Package os provides a platform-independent interface to operating system functionality.
+	"os/signal" // Package os/signal lets the proxy trap SIGINT/SIGTERM/SIGHUP for shutdown and reload.
+	"runtime"   // Package runtime provides operations that interact with Go's runtime system.
+	"strings"   // Package strings implements simple functions to manipulate UTF-8 encoded strings.
+	"sync"      // Package sync provides the WaitGroup used to wait for every mode to drain before exiting.
+	"syscall"   // Package syscall names the specific signals trapped below.
+	"time"      // Package time provides functionality for measuring and displaying time.
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+	"github.com/matveynator/chicha-tcp-proxy/logfile"
+	"github.com/matveynator/chicha-tcp-proxy/metrics"
+	"github.com/matveynator/chicha-tcp-proxy/mode"
 )
 
 // Route describes a single forwarding route configuration from a local port to a remote address.
+// Protocol: "tcp" or "udp" (defaults to "tcp" when the route has no "tcp/"/"udp/" prefix)
 // LocalPort: The local port on which the proxy listens (e.g. "8080")
 // RemoteIP: The target server IP address to forward traffic to (e.g. "46.4.70.114")
 // RemotePort: The remote port on the target server to forward traffic to (e.g. "80")
 type Route struct {
+	Protocol   string // "tcp" or "udp".
 	LocalPort  string // The local port number as a string.
 	RemoteIP   string // The remote IP address as a string.
 	RemotePort string // The remote port number as a string.
 }
 
+// String renders a route the way it is used as the "route" log field, e.g.
+// "tcp/8080->46.4.70.114:80".
+func (r Route) String() string {
+	return r.Protocol + "/" + r.LocalPort + "->" + r.RemoteIP + ":" + r.RemotePort
+}
+
 func main() {
-	// routesFlag holds the comma-separated list of routes in the format LOCALPORT:REMOTEIP:REMOTEPORT
-	routesFlag := flag.String("routes", "", "Comma-separated list of routes in the format LOCALPORT:REMOTEIP:REMOTEPORT")
+	// routesFlag holds the comma-separated list of static routes in the format LOCALPORT:REMOTEIP:REMOTEPORT.
+	// Prefixing the value with "@" (e.g. "@/etc/chicha-routes.conf") reads the list from that file instead,
+	// so SIGHUP can reload a changed set of routes from disk.
+	routesFlag := flag.String("routes", "", "Comma-separated list of static routes in the format [tcp/|udp/]LOCALPORT:REMOTEIP:REMOTEPORT (protocol defaults to tcp), or @file to read them from a file")
+	// socks5Addr, if set, starts a SOCKS5 front-end alongside any static routes.
+	socks5Addr := flag.String("socks5", "", "Listen address for a SOCKS5 front-end (e.g. ':1080'); empty disables it")
+	// socks5Allow/socks5Deny configure which targets the SOCKS5 front-end will dial.
+	socks5Allow := flag.String("socks5-allow", "", "Comma-separated hostnames/IPs/CIDRs the SOCKS5 front-end may dial; empty allows all")
+	socks5Deny := flag.String("socks5-deny", "", "Comma-separated hostnames/IPs/CIDRs the SOCKS5 front-end refuses to dial, checked before -socks5-allow")
+	// transparentAddr, if set, starts a Linux transparent (SO_ORIGINAL_DST) front-end.
+	transparentAddr := flag.String("transparent", "", "Listen address for a transparent TCP front-end using SO_ORIGINAL_DST (Linux only); empty disables it")
 	// logFile specifies the path to the log file where proxy activity will be logged.
 	logFile := flag.String("log", "chicha-tcp-proxy.log", "Path to the log file")
 	// rotationFrequency specifies how often the log file should be rotated.
-	rotationFrequency := flag.Duration("rotation", 24*time.Hour, "Log rotation frequency (e.g. 24h, 1h, etc.)")
+	rotationFrequency := flag.Duration("rotation", 24*time.Hour, "Log rotation frequency (e.g. 24h, 1h, etc.); 0 disables time-based rotation")
+	// maxSize specifies the size in bytes at which the log file rotates, regardless of rotationFrequency.
+	maxSize := flag.Int64("max-size", 0, "Rotate the log file once it reaches this many bytes (0 disables size-based rotation)")
+	// maxFiles specifies how many rotated log files to retain.
+	maxFiles := flag.Int("max-files", 7, "Number of rotated log files to retain (0 keeps them all)")
+	// logLevelFlag selects how verbose the structured logger is.
+	logLevelFlag := flag.String("loglevel", "INFO", "Log level: ERROR, WARN, INFO or DEBUG")
+	// shutdownTimeout bounds how long a SIGINT/SIGTERM waits for in-flight connections before force-closing them.
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight connections to finish after a shutdown signal before force-closing them")
+	// udpIdle bounds how long a udp/ route's NAT-style flow is kept open without traffic in either direction.
+	udpIdle := flag.Duration("udp-idle", 60*time.Second, "Idle timeout for udp/ routes before a flow's upstream socket is closed")
+	// maxConns bounds how many connections/flows may be active across every front-end at once.
+	maxConns := flag.Int("max-conns", 0, "Maximum number of connections/flows active across all front-ends at once (0 disables the limit)")
+	// maxConnsPerRoute bounds how many connections/flows may be active for a single front-end at once.
+	maxConnsPerRoute := flag.Int("max-conns-per-route", 0, "Maximum number of connections/flows active for a single front-end at once (0 disables the limit)")
+	// metricsAddr, if set, serves Prometheus text metrics (active/accepted/rejected connections, bytes, dial errors) per route and globally.
+	metricsAddr := flag.String("metrics", "", "Listen address for a Prometheus metrics endpoint (e.g. ':9090'); empty disables it")
 
 	// Parse the provided command-line flags.
 	flag.Parse()
 
-	// Validate that the required routes flag is provided.
-	if *routesFlag == "" {
-		log.Fatal("Error: The -routes flag is required.")
+	// At least one front-end must be configured.
+	if *routesFlag == "" && *socks5Addr == "" && *transparentAddr == "" {
+		log.Fatal("Error: at least one of -routes, -socks5 or -transparent is required.")
 	}
 
-	// Parse the routes from the provided string.
-	routes, err := parseRoutes(*routesFlag)
+	// Load the static routes, if any were given.
+	routes, err := loadRoutes(*routesFlag)
 	if err != nil {
-		log.Fatalf("Error parsing routes: %v", err)
+		log.Fatalf("Error loading routes: %v", err)
 	}
-	if len(routes) == 0 {
+	if *routesFlag != "" && len(routes) == 0 {
 		log.Fatalf("Error: no valid routes found in '%s'", *routesFlag)
 	}
 
+	level, err := clog.ParseLevel(*logLevelFlag)
+	if err != nil {
+		log.Fatalf("Error parsing -loglevel: %v", err)
+	}
+
 	// Print basic startup information: routes, log file, and rotation frequency.
 	fmt.Println("========== CHICHA TCP PROXY ==========")
-	fmt.Println("Routes:")
-	for _, route := range routes {
-		fmt.Printf("  LocalPort=%s -> RemoteIP=%s RemotePort=%s\n", route.LocalPort, route.RemoteIP, route.RemotePort)
+	if len(routes) > 0 {
+		fmt.Println("Routes:")
+		for _, route := range routes {
+			fmt.Printf("  %s/%s -> %s:%s\n", route.Protocol, route.LocalPort, route.RemoteIP, route.RemotePort)
+		}
+	}
+	if *socks5Addr != "" {
+		fmt.Printf("SOCKS5: %s\n", *socks5Addr)
+	}
+	if *transparentAddr != "" {
+		fmt.Printf("Transparent: %s\n", *transparentAddr)
 	}
 	fmt.Printf("Log file: %s\n", *logFile)
+	fmt.Printf("Log level: %s\n", level)
 	fmt.Printf("Log rotation frequency: %v\n", *rotationFrequency)
+	fmt.Printf("Log max size: %d bytes, max files: %d\n", *maxSize, *maxFiles)
+	fmt.Printf("Shutdown timeout: %v\n", *shutdownTimeout)
+	fmt.Printf("Max connections: %d total, %d per route\n", *maxConns, *maxConnsPerRoute)
+	if *metricsAddr != "" {
+		fmt.Printf("Metrics: %s\n", *metricsAddr)
+	}
 	fmt.Println("======================================")
 
-	// Set up the logger that will write to the specified log file.
-	logger, file, err := setupLogger(*logFile)
+	// Open the rotating log file and point the leveled logger at it.
+	lf, err := logfile.Open(logfile.Config{Path: *logFile, MaxSize: *maxSize, MaxFiles: *maxFiles})
 	if err != nil {
 		log.Fatalf("Error setting up logger: %v", err)
 	}
+	logger := clog.New(lf, level)
 
-	log.Printf("Starting chicha-tcp-proxy")
+	logger.Infof("starting chicha-tcp-proxy")
 
 	// Set the number of OS threads to use based on the number of CPUs available.
 	// According to Go proverbs, "Don't communicate by sharing memory; share memory by communicating."
 	// By default Go does this well, but we explicitly set it for clarity.
 	numCPUs := runtime.NumCPU()
 	runtime.GOMAXPROCS(numCPUs)
-	logger.Printf("Using %d CPU cores", numCPUs)
-	log.Printf("Using %d CPU cores", numCPUs)
-
-	// Start the log rotation in a separate goroutine. This periodically rotates logs without blocking the main execution.
-	go rotateLogs(*logFile, file, logger, *rotationFrequency)
+	logger.Infof("using CPU cores", clog.F("count", numCPUs))
+
+	// The root context drives the whole proxy's lifecycle: cancelling it is
+	// how a SIGINT/SIGTERM tells every listener to stop accepting and every
+	// in-flight connection to wind down. It also carries the logger so any
+	// subsystem below main can derive its own logger from it.
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = clog.WithLogger(ctx, logger)
+
+	// Start the log rotation timer in a separate goroutine. This periodically rotates logs without
+	// blocking the main execution; lf.Write also rotates on its own once -max-size is exceeded.
+	go lf.RunRotationTimer(ctx, *rotationFrequency)
+
+	// wg tracks every running mode; main only exits once it is fully
+	// drained, which happens after ctx is cancelled and every in-flight
+	// connection has finished or been force-closed by ForwardConn.
+	var wg sync.WaitGroup
+
+	// registry collects active/accepted/rejected connection counts, bytes
+	// transferred, and dial errors, per route and globally; globalLimit
+	// enforces -max-conns across every front-end sharing this one
+	// Semaphore, while each front-end gets its own -max-conns-per-route
+	// Semaphore.
+	registry := metrics.NewRegistry()
+	globalLimit := mode.NewSemaphore(*maxConns)
+
+	// startRoute launches a Static or UDP mode for route, depending on its
+	// Protocol, under its own cancellable context derived from the root
+	// one, so a single route can be stopped on reload without disturbing
+	// the others.
+	startRoute := func(route Route) *routeRunner {
+		routeCtx, routeCancel := context.WithCancel(ctx)
+		targetAddr := route.RemoteIP + ":" + route.RemotePort
+		routeLogger := logger.With(clog.F("route", route.String()))
+		routeLogger.Infof("starting proxy for route")
+
+		limiter := &mode.Limiter{Route: route.String(), Global: globalLimit, PerRoute: mode.NewSemaphore(*maxConnsPerRoute), Metrics: registry}
+		var m mode.Mode
+		if route.Protocol == "udp" {
+			m = &mode.UDP{ListenAddr: ":" + route.LocalPort, TargetAddr: targetAddr, IdleTimeout: *udpIdle, Logger: routeLogger, Limiter: limiter}
+		} else {
+			m = &mode.Static{ListenAddr: ":" + route.LocalPort, TargetAddr: targetAddr, Logger: routeLogger, ShutdownTimeout: *shutdownTimeout, Limiter: limiter}
+		}
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			runMode(routeCtx, m, routeLogger)
+		}()
+		return &routeRunner{route: route, cancel: routeCancel, done: done}
+	}
 
-	// Start the proxy servers for each route in separate goroutines. This allows concurrent handling of multiple routes.
+	// running tracks the currently active routes by local port, so a
+	// SIGHUP can diff a freshly loaded route list against what is actually
+	// listening right now.
+	running := make(map[string]*routeRunner, len(routes))
 	for _, route := range routes {
-		// Inform about starting a proxy instance for this route.
-		logger.Printf("Starting proxy for route: local=%s remote=%s:%s", route.LocalPort, route.RemoteIP, route.RemotePort)
-		log.Printf("Starting proxy for route: local=%s remote=%s:%s", route.LocalPort, route.RemoteIP, route.RemotePort)
-
-		// Launch a goroutine to handle incoming connections on the specified local port and forward them to the remote address.
-		go startProxy(":"+route.LocalPort, route.RemoteIP+":"+route.RemotePort, logger)
+		running[route.LocalPort] = startRoute(route)
 	}
 
-	// Block indefinitely to keep the main function running.
-	// Using select{} is a common idiom for blocking forever.
-	select {}
-}
+	if *socks5Addr != "" {
+		socksLogger := logger.With(clog.F("route", "socks5:"+*socks5Addr))
+		socksLogger.Infof("starting socks5 proxy")
+
+		socksLimiter := &mode.Limiter{Route: "socks5:" + *socks5Addr, Global: globalLimit, PerRoute: mode.NewSemaphore(*maxConnsPerRoute), Metrics: registry}
+		m := &mode.SOCKS5{ListenAddr: *socks5Addr, ACL: mode.NewACL(*socks5Allow, *socks5Deny), Logger: socksLogger, ShutdownTimeout: *shutdownTimeout, Limiter: socksLimiter}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMode(ctx, m, socksLogger)
+		}()
+	}
 
-// parseRoutes parses a comma-separated string of route definitions into a slice of Route objects.
-// The expected format for each route is "LOCALPORT:REMOTEIP:REMOTEPORT".
-func parseRoutes(routesFlag string) ([]Route, error) {
-	// Split the input on commas to separate individual route definitions.
-	parts := strings.Split(routesFlag, ",")
-	var routes []Route
-	for _, part := range parts {
-		// Split each route into its components: local port, remote IP, and remote port.
-		segments := strings.Split(part, ":")
-		if len(segments) != 3 {
-			return nil, fmt.Errorf("invalid route format: '%s' (expected LOCALPORT:REMOTEIP:REMOTEPORT)", part)
-		}
-		// Construct a Route struct and add it to the routes slice.
-		routes = append(routes, Route{
-			LocalPort:  segments[0],
-			RemoteIP:   segments[1],
-			RemotePort: segments[2],
-		})
+	if *transparentAddr != "" {
+		transLogger := logger.With(clog.F("route", "transparent:"+*transparentAddr))
+		transLogger.Infof("starting transparent proxy")
+
+		transLimiter := &mode.Limiter{Route: "transparent:" + *transparentAddr, Global: globalLimit, PerRoute: mode.NewSemaphore(*maxConnsPerRoute), Metrics: registry}
+		m := mode.NewTransparent(*transparentAddr, transLogger, *shutdownTimeout, transLimiter)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMode(ctx, m, transLogger)
+		}()
 	}
-	return routes, nil
-}
 
-// setupLogger creates or opens the specified log file and returns a logger and the file handle.
-// If the file does not exist, it will be created. Logs are appended if the file already exists.
-func setupLogger(logFile string) (*log.Logger, *os.File, error) {
-	// Open or create the log file with append mode.
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open log file '%s': %v", logFile, err)
+	if *metricsAddr != "" {
+		metricsLogger := logger.With(clog.F("route", "metrics:"+*metricsAddr))
+		metricsLogger.Infof("starting metrics endpoint")
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		metricsServer := &http.Server{Addr: *metricsAddr, Handler: mux}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			defer cancel()
+			metricsServer.Shutdown(shutdownCtx)
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				metricsLogger.Errorf("metrics endpoint exited", clog.F("error", err))
+			}
+		}()
 	}
 
-	// Create a new logger that writes to the opened file.
-	logger := log.New(file, "", log.LstdFlags)
-	return logger, file, nil
-}
+	// reloadRoutes diffs a freshly loaded route list against running:
+	// routes that disappeared or changed target are stopped, routes that
+	// are new are started, and anything unchanged is left alone.
+	reloadRoutes := func(newRoutes []Route) {
+		wanted := make(map[string]Route, len(newRoutes))
+		for _, route := range newRoutes {
+			wanted[route.LocalPort] = route
+		}
 
-// rotateLogs handles periodic rotation of the current log file. After rotation,
-// it compresses the old log file and starts a new one.
-// This runs indefinitely in a goroutine.
-func rotateLogs(logFile string, file *os.File, logger *log.Logger, frequency time.Duration) {
-	for {
-		// Sleep for the specified rotation frequency before rotating logs again.
-		time.Sleep(frequency)
-
-		// Close the current log file before renaming.
-		file.Close()
-
-		// Create a rotated filename based on the current date.
-		rotatedFile := logFile + "." + time.Now().Format("2006-01-02")
-		if err := os.Rename(logFile, rotatedFile); err != nil {
-			// If renaming fails, log the error and attempt to reopen the current log file to continue logging.
-			logger.Printf("Error rotating logs: %v", err)
-			log.Printf("Error rotating logs: %v", err)
-
-			newFile, err2 := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err2 != nil {
-				// If reopening also fails, we must terminate since we have nowhere to log.
-				logger.Fatalf("Failed to reopen log file after rotation error: %v", err2)
-				log.Fatalf("Failed to reopen log file after rotation error: %v", err2)
+		for port, runner := range running {
+			route, stillWanted := wanted[port]
+			if !stillWanted || route != runner.route {
+				logger.Infof("stopping route on reload", clog.F("route", runner.route.String()))
+				runner.cancel()
+				// Wait for the listener to actually close before a
+				// changed route can reuse the same port below; serve's
+				// listener.Close() runs in its own goroutine, so without
+				// this a same-port restart races it and loses to
+				// EADDRINUSE.
+				<-runner.done
+				delete(running, port)
 			}
-			file = newFile
-			logger.SetOutput(file)
-			continue
 		}
-
-		// After successful rename, open a new log file with the original name to continue logging.
-		newFile, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			logger.Fatalf("Failed to create new log file after rotation: %v", err)
-			log.Fatalf("Failed to create new log file after rotation: %v", err)
+		for port, route := range wanted {
+			if _, alreadyRunning := running[port]; alreadyRunning {
+				continue
+			}
+			running[port] = startRoute(route)
 		}
-		file = newFile
-		logger.SetOutput(file)
-
-		// Inform that the log was rotated and now compressing the old log file.
-		logger.Println("Log file rotated successfully, now compressing old log...")
-		log.Println("Log file rotated successfully, now compressing old log...")
+	}
 
-		// Compress the old log file to save space and then remove the uncompressed version.
-		if err := compressFile(rotatedFile); err != nil {
-			logger.Printf("Error compressing rotated file: %v", err)
-			log.Printf("Error compressing rotated file: %v", err)
-		} else {
-			logger.Printf("Compression successful: %s.gz", rotatedFile)
-			log.Printf("Compression successful: %s.gz", rotatedFile)
-			if err := os.Remove(rotatedFile); err != nil {
-				logger.Printf("Error removing uncompressed rotated file: %v", err)
-				log.Printf("Error removing uncompressed rotated file: %v", err)
+	// Trap SIGINT/SIGTERM to start a graceful shutdown, and SIGHUP to
+	// reload -routes without disturbing unrelated connections.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				newRoutes, err := loadRoutes(*routesFlag)
+				if err != nil {
+					logger.Errorf("failed to reload routes", clog.F("error", err))
+					continue
+				}
+				reloadRoutes(newRoutes)
+				continue
 			}
+			logger.Infof("received shutdown signal", clog.F("signal", sig.String()))
+			cancel()
+			return
 		}
-	}
+	}()
+
+	// Block until a shutdown signal cancels ctx, then wait for every mode
+	// to finish draining its in-flight connections (bounded by
+	// -shutdown-timeout) before exiting.
+	<-ctx.Done()
+	logger.Infof("shutting down, waiting for connections to drain", clog.F("shutdown_timeout", shutdownTimeout.String()))
+	wg.Wait()
+	logger.Infof("shutdown complete")
+	lf.Close()
 }
 
-// compressFile takes a filename and compresses it using gzip, creating a .gz file.
-// After compression, the original file can be removed by the caller.
-func compressFile(filename string) error {
-	// Open the original file for reading.
-	original, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open file for compression: %v", err)
-	}
-	defer original.Close()
-
-	// Create a new .gz file for writing the compressed data.
-	gzFile, err := os.OpenFile(filename+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to create gz file: %v", err)
-	}
-	defer gzFile.Close()
-
-	// Create a gzip writer to compress data as it's written.
-	gzWriter := gzip.NewWriter(gzFile)
-	defer gzWriter.Close()
-
-	// Copy all data from the original file into the gzip writer (which compresses it).
-	if _, err := io.Copy(gzWriter, original); err != nil {
-		return fmt.Errorf("failed to copy data for compression: %v", err)
-	}
-
-	return nil
+// routeRunner tracks one running static route, so reloadRoutes can stop it
+// by cancelling its context and wait, via done, until its listener has
+// actually released the port.
+type routeRunner struct {
+	route  Route
+	cancel context.CancelFunc
+	done   chan struct{} // closed once runMode returns
 }
 
-// startProxy listens on the specified local address and forwards all connections to the target address.
-// Each accepted connection is passed through a channel to be handled by worker goroutines.
-func startProxy(listenAddr, targetAddr string, logger *log.Logger) {
-	// Listen for incoming TCP connections on the given local address.
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		logger.Fatalf("Failed to start proxy on %s: %v", listenAddr, err)
+// runMode runs m until ctx is cancelled or it fails, logging the failure.
+// It exists so every front-end can be launched the same one-line way from
+// main regardless of which Mode implementation it is.
+func runMode(ctx context.Context, m mode.Mode, logger *clog.Logger) {
+	if err := m.Run(ctx); err != nil {
+		logger.Errorf("mode exited", clog.F("error", err))
 	}
-	defer listener.Close()
-
-	logger.Printf("Proxy started on %s forwarding to %s", listenAddr, targetAddr)
-
-	// Create a channel to distribute accepted connections to worker goroutines.
-	connChan := make(chan net.Conn)
+}
 
-	// Spawn worker goroutines to handle connections concurrently.
-	// Using the number of CPUs as the number of workers is a common approach.
-	for i := 0; i < runtime.NumCPU(); i++ {
-		go handleConnections(connChan, targetAddr, logger)
+// loadRoutes loads a route list from spec, which is either a literal
+// comma-separated LOCALPORT:REMOTEIP:REMOTEPORT list or, if prefixed with
+// "@", a path to a file containing one. An empty spec yields no routes.
+func loadRoutes(spec string) ([]Route, error) {
+	if spec == "" {
+		return nil, nil
 	}
-
-	// Continuously accept new client connections and send them to the channel for processing.
-	for {
-		clientConn, err := listener.Accept()
+	if path, ok := strings.CutPrefix(spec, "@"); ok {
+		data, err := os.ReadFile(path)
 		if err != nil {
-			logger.Printf("Error accepting connection on %s: %v", listenAddr, err)
-			continue // If there's a transient error, continue accepting the next connection.
+			return nil, fmt.Errorf("failed to read routes file '%s': %v", path, err)
+		}
+		spec = strings.TrimSpace(string(data))
+		if spec == "" {
+			return nil, nil
 		}
-		// Send the new connection to one of the worker goroutines via the channel.
-		connChan <- clientConn
 	}
+	return parseRoutes(spec)
 }
 
-// handleConnections receives connections from the channel and sets up bidirectional data copying
-// between the client and the remote server. It uses goroutines for each direction of traffic.
-// This function blocks, reading from connChan, until the channel is closed or the program is terminated.
-func handleConnections(connChan <-chan net.Conn, targetAddr string, logger *log.Logger) {
-	for {
-		// Use a select statement for possible future expansions (like graceful shutdown).
-		select {
-		case clientConn, ok := <-connChan:
-			if !ok {
-				// If the channel is closed, return to stop this worker.
-				return
+// parseRoutes parses a comma-separated string of route definitions into a slice of Route objects.
+// The expected format for each route is "[tcp/|udp/]LOCALPORT:REMOTEIP:REMOTEPORT"; a route with
+// no "tcp/"/"udp/" prefix defaults to tcp.
+func parseRoutes(routesFlag string) ([]Route, error) {
+	// Split the input on commas to separate individual route definitions.
+	parts := strings.Split(routesFlag, ",")
+	var routes []Route
+	for _, part := range parts {
+		protocol := "tcp"
+		spec := part
+		if proto, rest, ok := strings.Cut(part, "/"); ok {
+			protocol = strings.ToLower(proto)
+			if protocol != "tcp" && protocol != "udp" {
+				return nil, fmt.Errorf("invalid route protocol: '%s' (expected tcp or udp)", proto)
 			}
+			spec = rest
+		}
 
-			// For each client connection, start a new goroutine to handle forwarding.
-			go func(conn net.Conn) {
-				defer conn.Close()
-
-				clientAddr := conn.RemoteAddr().String()
-				logger.Printf("New connection: %s -> %s", clientAddr, targetAddr)
-
-				// Dial the target server.
-				serverConn, err := net.Dial("tcp", targetAddr)
-				if err != nil {
-					logger.Printf("Failed to connect to server %s: %v", targetAddr, err)
-					return
-				}
-				defer serverConn.Close()
-
-				// done channel signals when copying in each direction finishes.
-				done := make(chan struct{}, 2)
-
-				// Copy data from client to server.
-				go func() {
-					_, err := io.Copy(serverConn, conn)
-					if err != nil && err != io.EOF {
-						logger.Printf("Error copying from client %s to server %s: %v", clientAddr, targetAddr, err)
-					}
-					done <- struct{}{}
-				}()
-
-				// Copy data from server to client.
-				go func() {
-					_, err := io.Copy(conn, serverConn)
-					if err != nil && err != io.EOF {
-						logger.Printf("Error copying from server %s to client %s: %v", targetAddr, clientAddr, err)
-					}
-					done <- struct{}{}
-				}()
-
-				// Wait for both copy operations to complete before closing the connection.
-				<-done
-				<-done
-
-				logger.Printf("Connection closed: %s -> %s", clientAddr, targetAddr)
-			}(clientConn)
+		// Split each route into its components: local port, remote IP, and remote port.
+		segments := strings.Split(spec, ":")
+		if len(segments) != 3 {
+			return nil, fmt.Errorf("invalid route format: '%s' (expected [tcp/|udp/]LOCALPORT:REMOTEIP:REMOTEPORT)", part)
 		}
+		// Construct a Route struct and add it to the routes slice.
+		routes = append(routes, Route{
+			Protocol:   protocol,
+			LocalPort:  segments[0],
+			RemoteIP:   segments[1],
+			RemotePort: segments[2],
+		})
 	}
+	return routes, nil
 }
@@ -0,0 +1,257 @@
+// Package logfile implements the rotating log file chicha-tcp-proxy writes
+// its structured logs to. It grew out of a single rotateLogs goroutine into
+// a small subsystem modeled on Docker's loggerutils: rotation can be
+// triggered either by elapsed time or by file size, rotated files are kept
+// as a numbered retention set, gzipped from slot 2 on (log.1, log.2.gz, ...)
+// instead of a single dated backup, and each gzip'd file carries a small
+// JSON header recording when its last entry was written.
+package logfile
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Config controls one LogFile's rotation behaviour.
+type Config struct {
+	Path string // path to the active log file, e.g. "chicha-tcp-proxy.log"
+
+	// MaxSize is the size in bytes at which a write triggers rotation.
+	// Zero disables size-based rotation.
+	MaxSize int64
+
+	// MaxFiles is how many rotated files (log.1, log.2.gz, ...) are kept.
+	// The oldest beyond this count is deleted on rotation. Zero keeps every
+	// rotated file.
+	MaxFiles int
+}
+
+// gzipHeader is the small JSON document written into a rotated file's gzip
+// Comment field, so operators can tell which rotated file covers which
+// period without decompressing every one of them.
+type gzipHeader struct {
+	LastTime time.Time `json:"lastTime"`
+}
+
+// LogFile is an io.Writer backed by a file that rotates itself, either when
+// it grows past Config.MaxSize or when RunRotationTimer's interval elapses.
+// All state is only ever touched while holding the token from mu, a
+// 1-buffered channel used as a mutex, so a size-triggered rotation from
+// Write and a time-triggered rotation from RunRotationTimer can never
+// interleave and tear a log line in half.
+type LogFile struct {
+	cfg Config
+
+	mu   chan struct{} // acquired by receiving, released by sending back
+	file *os.File
+	size int64 // bytes written to file since it was opened
+}
+
+// Open creates or appends to cfg.Path and returns a ready-to-write LogFile.
+func Open(cfg Config) (*LogFile, error) {
+	file, err := openAppend(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file '%s': %v", cfg.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat log file '%s': %v", cfg.Path, err)
+	}
+
+	lf := &LogFile{
+		cfg:  cfg,
+		mu:   make(chan struct{}, 1),
+		file: file,
+		size: info.Size(),
+	}
+	lf.mu <- struct{}{} // start unlocked
+	return lf, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// Write appends p to the active file, rotating first if MaxSize is set and
+// p would push the file past it. It implements io.Writer so a LogFile can
+// be handed straight to common/log.New.
+func (lf *LogFile) Write(p []byte) (int, error) {
+	<-lf.mu
+	defer func() { lf.mu <- struct{}{} }()
+
+	if lf.cfg.MaxSize > 0 && lf.size+int64(len(p)) > lf.cfg.MaxSize {
+		if err := lf.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := lf.file.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// RotateNow rotates the log file immediately, regardless of its current
+// size. It is exported so a future SIGHUP handler can trigger it directly.
+func (lf *LogFile) RotateNow() error {
+	<-lf.mu
+	defer func() { lf.mu <- struct{}{} }()
+	return lf.rotateLocked()
+}
+
+// RunRotationTimer rotates the log file every interval until ctx is
+// cancelled. A zero interval disables timer-based rotation entirely, which
+// leaves size-based rotation (if configured) as the only trigger.
+func (lf *LogFile) RunRotationTimer(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := lf.RotateNow(); err != nil {
+			fmt.Fprintf(os.Stderr, "chicha-tcp-proxy: error rotating log file: %v\n", err)
+		}
+	}
+}
+
+// Close closes the active file.
+func (lf *LogFile) Close() error {
+	<-lf.mu
+	defer func() { lf.mu <- struct{}{} }()
+	return lf.file.Close()
+}
+
+// rotateLocked shifts the retention set and renames the active file to
+// "<path>.1" in its place. Slot 1 is always the most recent rotated file
+// and is kept uncompressed, the same way newsyslog/logrotate keep their
+// ".0"/".1" slot plain; every older slot (2 and up) is gzipped, so slot 1
+// is only compressed once rotation shifts it out into slot 2. The caller
+// must hold mu.
+func (lf *LogFile) rotateLocked() error {
+	// Shift existing rotated files up by one slot, oldest first, dropping
+	// anything that would land beyond MaxFiles. Starting from the highest
+	// slot that actually exists - rather than an arbitrary upper bound -
+	// is what makes a MaxFiles of zero keep every rotated file rather than
+	// silently losing the oldest one once the retention set outgrows some
+	// hard-coded cap.
+	for n := lf.highestSlot(); n >= 1; n-- {
+		toGz := lf.slot(n+1) + ".gz"
+
+		if lf.cfg.MaxFiles > 0 && n+1 > lf.cfg.MaxFiles {
+			os.Remove(lf.slot(n))
+			os.Remove(lf.slot(n) + ".gz")
+			continue
+		}
+
+		if n == 1 {
+			// Slot 1 is plain text; it only gets gzipped now, as it
+			// shifts into slot 2 and stops being the newest rotated file.
+			from := lf.slot(1)
+			info, err := os.Stat(from)
+			if err != nil {
+				continue // nothing in slot 1 yet
+			}
+			if err := compressFile(from, info.ModTime()); err != nil {
+				return fmt.Errorf("failed to compress rotated log file '%s': %v", from, err)
+			}
+			if err := os.Rename(from+".gz", toGz); err != nil {
+				return fmt.Errorf("failed to rotate compressed log file '%s': %v", from, err)
+			}
+			os.Remove(from)
+			continue
+		}
+
+		fromGz := lf.slot(n) + ".gz"
+		if _, err := os.Stat(fromGz); err == nil {
+			os.Rename(fromGz, toGz)
+		}
+	}
+
+	// Close the active file before renaming it; Windows in particular
+	// cannot rename an open file, and doing this unconditionally keeps the
+	// rename+reopen atomic with respect to other writers, which are all
+	// blocked on mu anyway.
+	lf.file.Close()
+
+	rotated := lf.slot(1)
+	if err := os.Rename(lf.cfg.Path, rotated); err != nil {
+		// Reopen the original path so logging can continue even though
+		// this rotation failed.
+		file, openErr := openAppend(lf.cfg.Path)
+		if openErr == nil {
+			lf.file = file
+		}
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+
+	newFile, err := openAppend(lf.cfg.Path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen log file after rotation: %v", err)
+	}
+	lf.file = newFile
+	lf.size = 0
+	return nil
+}
+
+// highestSlot returns the highest rotation slot that currently has a file
+// in it, plain or gzipped, or 0 if no rotated file exists yet.
+func (lf *LogFile) highestSlot() int {
+	n := 0
+	for {
+		next := n + 1
+		if _, err := os.Stat(lf.slot(next)); err == nil {
+			n = next
+			continue
+		}
+		if _, err := os.Stat(lf.slot(next) + ".gz"); err == nil {
+			n = next
+			continue
+		}
+		return n
+	}
+}
+
+func (lf *LogFile) slot(n int) string {
+	return fmt.Sprintf("%s.%d", lf.cfg.Path, n)
+}
+
+// compressFile gzips filename into filename+".gz", embedding a small JSON
+// header in the gzip Comment field recording lastTime, the timestamp of the
+// newest entry the file contains. That lets operators locate the right
+// rotated file by time without decompressing each candidate.
+func compressFile(filename string, lastTime time.Time) error {
+	original, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for compression: %v", err)
+	}
+	defer original.Close()
+
+	gzFile, err := os.OpenFile(filename+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create gz file: %v", err)
+	}
+	defer gzFile.Close()
+
+	header, err := json.Marshal(gzipHeader{LastTime: lastTime})
+	if err != nil {
+		return fmt.Errorf("failed to marshal gzip header: %v", err)
+	}
+
+	gzWriter := gzip.NewWriter(gzFile)
+	gzWriter.Comment = string(header)
+	defer gzWriter.Close()
+
+	if _, err := io.Copy(gzWriter, original); err != nil {
+		return fmt.Errorf("failed to copy data for compression: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rotatedFiles returns which of slot 1..n exist under path, plain or
+// gzipped, as a "1", "2.gz", ... slice in ascending slot order.
+func rotatedFiles(t *testing.T, path string, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 1; i <= n; i++ {
+		slot := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(slot); err == nil {
+			got = append(got, fmt.Sprintf("%d", i))
+		}
+		if _, err := os.Stat(slot + ".gz"); err == nil {
+			got = append(got, fmt.Sprintf("%d.gz", i))
+		}
+	}
+	return got
+}
+
+func TestRotateLockedSlotShifting(t *testing.T) {
+	cases := []struct {
+		name      string
+		maxFiles  int
+		rotations int
+		wantSlots []string
+	}{
+		{name: "first rotation has nothing to shift", maxFiles: 0, rotations: 1, wantSlots: []string{"1"}},
+		{name: "second rotation gzips slot 1 into slot 2", maxFiles: 0, rotations: 2, wantSlots: []string{"1", "2.gz"}},
+		{name: "unlimited retention keeps every rotated file", maxFiles: 0, rotations: 5, wantSlots: []string{"1", "2.gz", "3.gz", "4.gz", "5.gz"}},
+		{name: "MaxFiles caps the retention set", maxFiles: 3, rotations: 5, wantSlots: []string{"1", "2.gz", "3.gz"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "chicha-tcp-proxy.log")
+
+			lf, err := Open(Config{Path: path, MaxFiles: c.maxFiles})
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer lf.Close()
+
+			for i := 0; i < c.rotations; i++ {
+				if _, err := lf.Write([]byte("line\n")); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				if err := lf.RotateNow(); err != nil {
+					t.Fatalf("RotateNow: %v", err)
+				}
+			}
+
+			got := rotatedFiles(t, path, c.rotations+1)
+			if !equalSlices(got, c.wantSlots) {
+				t.Errorf("rotated files = %v, want %v", got, c.wantSlots)
+			}
+		})
+	}
+}
+
+func equalSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+// Package metrics tracks per-route and global connection counters and
+// serves them over HTTP as Prometheus text exposition, so an operator can
+// watch active/accepted/rejected connections, bytes transferred, and dial
+// errors without grepping the log file.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// counters holds the raw counts for one route, or for the global
+// aggregate across every route.
+type counters struct {
+	active        int64
+	acceptedTotal int64
+	rejectedTotal int64
+	bytesUp       int64
+	bytesDown     int64
+	dialErrors    int64
+}
+
+// Registry tracks counters per route plus a global aggregate across all of
+// them. The zero value is not usable; use NewRegistry.
+type Registry struct {
+	global counters
+
+	mu     sync.Mutex
+	routes map[string]*counters
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{routes: make(map[string]*counters)}
+}
+
+// route returns the counters for route, creating them on first use.
+func (r *Registry) route(route string) *counters {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.routes[route]
+	if !ok {
+		c = &counters{}
+		r.routes[route] = c
+	}
+	return c
+}
+
+// Accepted records a newly accepted connection for route, counting it
+// against both that route and the global total.
+func (r *Registry) Accepted(route string) {
+	atomic.AddInt64(&r.global.active, 1)
+	atomic.AddInt64(&r.global.acceptedTotal, 1)
+	c := r.route(route)
+	atomic.AddInt64(&c.active, 1)
+	atomic.AddInt64(&c.acceptedTotal, 1)
+}
+
+// Closed records a connection previously counted by Accepted finishing.
+func (r *Registry) Closed(route string) {
+	atomic.AddInt64(&r.global.active, -1)
+	atomic.AddInt64(&r.route(route).active, -1)
+}
+
+// Rejected records a connection turned away before it counted as accepted,
+// e.g. because a -max-conns/-max-conns-per-route limit was reached.
+func (r *Registry) Rejected(route string) {
+	atomic.AddInt64(&r.global.rejectedTotal, 1)
+	atomic.AddInt64(&r.route(route).rejectedTotal, 1)
+}
+
+// DialError records a failed attempt to dial a connection's target.
+func (r *Registry) DialError(route string) {
+	atomic.AddInt64(&r.global.dialErrors, 1)
+	atomic.AddInt64(&r.route(route).dialErrors, 1)
+}
+
+// AddBytes records bytes forwarded in each direction for one connection.
+func (r *Registry) AddBytes(route string, up, down int64) {
+	atomic.AddInt64(&r.global.bytesUp, up)
+	atomic.AddInt64(&r.global.bytesDown, down)
+	c := r.route(route)
+	atomic.AddInt64(&c.bytesUp, up)
+	atomic.AddInt64(&c.bytesDown, down)
+}
+
+// metricDef describes one exported Prometheus metric: its name, help text,
+// type, and how to read it off a *counters.
+type metricDef struct {
+	name string
+	help string
+	typ  string
+	get  func(*counters) int64
+}
+
+var metricDefs = []metricDef{
+	{"chicha_tcp_proxy_active_connections", "Number of currently active connections.", "gauge",
+		func(c *counters) int64 { return atomic.LoadInt64(&c.active) }},
+	{"chicha_tcp_proxy_accepted_connections_total", "Total number of connections accepted.", "counter",
+		func(c *counters) int64 { return atomic.LoadInt64(&c.acceptedTotal) }},
+	{"chicha_tcp_proxy_rejected_connections_total", "Total number of connections rejected by a connection limit.", "counter",
+		func(c *counters) int64 { return atomic.LoadInt64(&c.rejectedTotal) }},
+	{"chicha_tcp_proxy_bytes_up_total", "Total bytes forwarded from client to target.", "counter",
+		func(c *counters) int64 { return atomic.LoadInt64(&c.bytesUp) }},
+	{"chicha_tcp_proxy_bytes_down_total", "Total bytes forwarded from target to client.", "counter",
+		func(c *counters) int64 { return atomic.LoadInt64(&c.bytesDown) }},
+	{"chicha_tcp_proxy_dial_errors_total", "Total number of failed attempts to dial a connection's target.", "counter",
+		func(c *counters) int64 { return atomic.LoadInt64(&c.dialErrors) }},
+}
+
+// Handler returns an http.Handler serving every counter, global and
+// per-route, in Prometheus text exposition format. The global aggregate is
+// labeled route="_global".
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		routes := make(map[string]*counters, len(r.routes))
+		for name, c := range r.routes {
+			routes[name] = c
+		}
+		r.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range metricDefs {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+			fmt.Fprintf(w, "%s{route=\"_global\"} %d\n", m.name, m.get(&r.global))
+			for name, c := range routes {
+				fmt.Fprintf(w, "%s{route=%q} %d\n", m.name, name, m.get(c))
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package mode
+
+import (
+	"net"
+	"strings"
+)
+
+// ACL decides whether a SOCKS5 client may be forwarded to a given
+// host:port, by checking a deny list before an allow list - the same order
+// a firewall rule set is usually read in.
+type ACL struct {
+	allow []string
+	deny  []string
+}
+
+// NewACL builds an ACL from comma-separated lists of hostnames, bare IPs or
+// CIDR blocks. Either list may be empty; an empty allow list permits
+// everything that isn't denied.
+func NewACL(allowCSV, denyCSV string) *ACL {
+	return &ACL{allow: splitCSV(allowCSV), deny: splitCSV(denyCSV)}
+}
+
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// Allowed reports whether hostport (e.g. "93.184.216.34:443" or
+// "example.com:443") may be dialed.
+func (a *ACL) Allowed(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	for _, pattern := range a.deny {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, pattern := range a.allow {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost reports whether host matches pattern, which is either a CIDR
+// block (checked against host parsed as an IP) or an exact hostname/IP.
+func matchHost(pattern, host string) bool {
+	if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && ipnet.Contains(ip)
+	}
+	return strings.EqualFold(pattern, host)
+}
@@ -0,0 +1,107 @@
+package mode
+
+import (
+	"github.com/matveynator/chicha-tcp-proxy/metrics"
+)
+
+// Semaphore is a buffered-channel token bucket bounding concurrent
+// connections: Acquire is non-blocking, so a full Semaphore means "reject
+// this connection", not "make it wait". A nil Semaphore (from
+// NewSemaphore(0) or smaller) is unlimited.
+type Semaphore chan struct{}
+
+// NewSemaphore returns a Semaphore allowing at most n concurrent holders.
+// n <= 0 means unlimited.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire reserves one slot, returning false immediately if none is free.
+func (s Semaphore) Acquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot reserved by Acquire.
+func (s Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// Limiter bounds a single front-end's concurrent connections with a global
+// and a per-route Semaphore - -max-conns and -max-conns-per-route - and
+// reports its activity to a metrics.Registry. A nil *Limiter imposes no
+// limit and reports no metrics, the same way a nil *ACL allows everything.
+type Limiter struct {
+	Route    string
+	Global   Semaphore
+	PerRoute Semaphore
+	Metrics  *metrics.Registry
+}
+
+// acquire reserves a connection slot against both the global and per-route
+// semaphores, recording the outcome in Metrics. It returns false if either
+// semaphore is full, in which case no slot is held and the caller must not
+// call release.
+func (l *Limiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if !l.Global.Acquire() {
+		l.reject()
+		return false
+	}
+	if !l.PerRoute.Acquire() {
+		l.Global.Release()
+		l.reject()
+		return false
+	}
+	if l.Metrics != nil {
+		l.Metrics.Accepted(l.Route)
+	}
+	return true
+}
+
+func (l *Limiter) reject() {
+	if l.Metrics != nil {
+		l.Metrics.Rejected(l.Route)
+	}
+}
+
+// release frees a slot reserved by a successful acquire.
+func (l *Limiter) release() {
+	if l == nil {
+		return
+	}
+	l.PerRoute.Release()
+	l.Global.Release()
+	if l.Metrics != nil {
+		l.Metrics.Closed(l.Route)
+	}
+}
+
+// dialError records a failed upstream dial.
+func (l *Limiter) dialError() {
+	if l != nil && l.Metrics != nil {
+		l.Metrics.DialError(l.Route)
+	}
+}
+
+// addBytes records bytes forwarded in each direction for one connection.
+func (l *Limiter) addBytes(up, down int64) {
+	if l != nil && l.Metrics != nil {
+		l.Metrics.AddBytes(l.Route, up, down)
+	}
+}
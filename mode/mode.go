@@ -0,0 +1,186 @@
+// Package mode splits chicha-tcp-proxy's front-ends into pluggable Modes,
+// in the spirit of shapeshifter-dispatcher's split between its static
+// "pt_socks5" and "transparent_tcp" modes. The original LOCALPORT:REMOTEIP:
+// REMOTEPORT static routes are one Mode among several; a SOCKS5 front-end
+// and a Linux transparent (SO_ORIGINAL_DST) front-end are others. Every
+// Mode shares the same accept-loop plumbing (serve) and the same
+// connection forwarding and logging (ForwardConn), so adding a new
+// front-end only means deciding how to resolve a target address, not how
+// to copy bytes or log a connection. ForwardConn also optionally applies a
+// Limiter bounding concurrent connections and reporting to metrics.Registry.
+package mode
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// Mode is a pluggable proxy front-end: something that accepts incoming
+// connections and, by whatever means suits it, resolves each one to a
+// target address and forwards it there.
+type Mode interface {
+	// Run listens and serves connections until ctx is cancelled or a fatal
+	// error occurs. Run only returns once every connection it accepted has
+	// finished or been force-closed, so a caller waiting on it knows the
+	// mode has fully drained.
+	Run(ctx context.Context) error
+}
+
+// serve runs the accept loop shared by every Mode: each accepted
+// connection is handed to handle in its own goroutine so one slow
+// connection never blocks the next Accept. Goroutine and fd count are
+// bounded by the caller's Limiter, which handle acquires before dialing
+// out, not by serve itself - an extra fixed-size dispatch pool in front of
+// an already-unbounded per-connection goroutine would only add a layer of
+// indirection, not an actual bound. A SOCKS5 handshake runs before its
+// Limiter is acquired, so connections still in the handshake are not
+// counted against it. Once ctx is cancelled, serve closes
+// the listener to unblock Accept and waits for every in-flight handle call
+// to return before it returns itself - handle is expected to honor ctx and
+// tear its connection down within a bounded time, which is ForwardConn's
+// job.
+func serve(ctx context.Context, listener net.Listener, logger *clog.Logger, handle func(context.Context, net.Conn)) error {
+	// Closing the listener is what unblocks Accept once ctx is cancelled.
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var conns sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				conns.Wait()
+				return nil
+			default:
+			}
+			logger.Warnf("error accepting connection", clog.F("listen_addr", listener.Addr().String()), clog.F("error", err))
+			continue
+		}
+		conns.Add(1)
+		go func(c net.Conn) {
+			defer conns.Done()
+			handle(ctx, c)
+		}(conn)
+	}
+}
+
+// copyBufferPool pools the buffers io.CopyBuffer uses for each direction of
+// a forwarded connection, so a busy proxy with many concurrent connections
+// doesn't allocate a fresh 32KB buffer per direction per connection.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} { return make([]byte, 32*1024) },
+}
+
+// ForwardConn dials targetAddr and copies data bidirectionally between
+// clientConn and it, logging a structured line when the connection starts
+// and another when it closes, with bytes transferred in each direction and
+// total duration. clientConn is always closed before ForwardConn returns.
+//
+// If ctx is cancelled while the copy is in flight, ForwardConn gives it
+// shutdownTimeout to finish on its own before force-closing both ends, so
+// graceful shutdown cannot hang forever on one stuck connection.
+//
+// limiter, if non-nil, bounds concurrent connections and reports the
+// connection's lifecycle to a metrics.Registry; a connection turned away
+// by limiter never reaches the target and is not logged as a connection.
+func ForwardConn(ctx context.Context, logger *clog.Logger, clientConn net.Conn, targetAddr string, shutdownTimeout time.Duration, limiter *Limiter) {
+	defer clientConn.Close()
+
+	if !limiter.acquire() {
+		logger.Warnf("connection rejected: limit reached", logger.ClientAddrField(clientConn.RemoteAddr().String()), clog.F("target", targetAddr))
+		return
+	}
+	defer limiter.release()
+
+	clientAddr := clientConn.RemoteAddr().String()
+	connID := clog.NextConnID()
+	// Derive a per-connection logger carrying the connection id and
+	// (scrubbed, unless -loglevel=DEBUG) client address, so every line for
+	// this connection can be correlated without repeating those fields.
+	connLogger := logger.With(clog.F("conn_id", connID), logger.ClientAddrField(clientAddr))
+	start := time.Now()
+	connLogger.Infof("new connection", clog.F("target", targetAddr))
+
+	serverConn, err := net.Dial("tcp", targetAddr)
+	if err != nil {
+		connLogger.Warnf("failed to connect to server", clog.F("target", targetAddr), clog.F("error", err))
+		limiter.dialError()
+		return
+	}
+	defer serverConn.Close()
+
+	// Once the connection is done (naturally or via shutdown below), stop
+	// the watcher below so it doesn't force-close a connection that has
+	// already finished and whose file descriptor may have been reused.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-finished:
+			return
+		}
+		select {
+		case <-time.After(shutdownTimeout):
+			connLogger.Warnf("force-closing connection after shutdown timeout", clog.F("target", targetAddr))
+			clientConn.Close()
+			serverConn.Close()
+		case <-finished:
+		}
+	}()
+
+	// done carries the byte count copied in each direction, tagged so the
+	// two results can be told apart regardless of which finishes first.
+	type direction int
+	const (
+		upstream direction = iota
+		downstream
+	)
+	type copyResult struct {
+		dir   direction
+		bytes int64
+		err   error
+	}
+	done := make(chan copyResult, 2)
+
+	go func() {
+		buf := copyBufferPool.Get().([]byte)
+		defer copyBufferPool.Put(buf)
+		n, err := io.CopyBuffer(serverConn, clientConn, buf)
+		done <- copyResult{dir: upstream, bytes: n, err: err}
+	}()
+	go func() {
+		buf := copyBufferPool.Get().([]byte)
+		defer copyBufferPool.Put(buf)
+		n, err := io.CopyBuffer(clientConn, serverConn, buf)
+		done <- copyResult{dir: downstream, bytes: n, err: err}
+	}()
+
+	var bytesUp, bytesDown int64
+	for i := 0; i < 2; i++ {
+		r := <-done
+		if r.err != nil && r.err != io.EOF {
+			connLogger.Warnf("error copying connection", clog.F("target", targetAddr), clog.F("error", r.err))
+		}
+		if r.dir == upstream {
+			bytesUp = r.bytes
+		} else {
+			bytesDown = r.bytes
+		}
+	}
+
+	limiter.addBytes(bytesUp, bytesDown)
+	connLogger.Infof("connection closed",
+		clog.F("target", targetAddr),
+		clog.F("bytes_up", bytesUp),
+		clog.F("bytes_down", bytesDown),
+		clog.F("duration", time.Since(start)))
+}
@@ -0,0 +1,186 @@
+package mode
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// SOCKS5 protocol constants used by the handshake below (RFC 1928). Only
+// the no-auth method and the CONNECT command are implemented, which is all
+// a forwarding proxy needs.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUnacceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5ReplySuccess         = 0x00
+	socks5ReplyGeneralFailure  = 0x01
+	socks5ReplyNotAllowed      = 0x02
+	socks5ReplyCmdNotSupported = 0x07
+)
+
+// SOCKS5 is a Mode that speaks the SOCKS5 CONNECT handshake and forwards to
+// whatever host:port the client asks for, subject to ACL.
+type SOCKS5 struct {
+	ListenAddr string
+	ACL        *ACL
+	Logger     *clog.Logger
+
+	// ShutdownTimeout bounds how long a connection is given to finish on
+	// its own after ctx is cancelled before it is force-closed.
+	ShutdownTimeout time.Duration
+
+	// Limiter, if non-nil, bounds concurrent connections and reports
+	// metrics for this route.
+	Limiter *Limiter
+}
+
+// Run listens on s.ListenAddr and serves SOCKS5 CONNECT requests until ctx
+// is cancelled.
+func (s *SOCKS5) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start socks5 proxy on %s: %v", s.ListenAddr, err)
+	}
+	s.Logger.Infof("socks5 proxy started", clog.F("listen_addr", s.ListenAddr))
+
+	return serve(ctx, listener, s.Logger, func(ctx context.Context, conn net.Conn) {
+		// ForwardConn's shutdown watcher only starts after the handshake, so a
+		// client stalled mid-handshake is force-closed here instead.
+		handshakeDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				select {
+				case <-time.After(s.ShutdownTimeout):
+					conn.Close()
+				case <-handshakeDone:
+				}
+			case <-handshakeDone:
+			}
+		}()
+		target, err := socks5Handshake(conn, s.ACL)
+		close(handshakeDone)
+		if err != nil {
+			s.Logger.Warnf("socks5 handshake failed", s.Logger.ClientAddrField(conn.RemoteAddr().String()), clog.F("error", err))
+			conn.Close()
+			return
+		}
+		ForwardConn(ctx, s.Logger, conn, target, s.ShutdownTimeout, s.Limiter)
+	})
+}
+
+// socks5Handshake negotiates no-auth, reads a CONNECT request off conn,
+// checks it against acl, writes the corresponding reply, and returns the
+// requested target as a host:port string. On error, conn has already been
+// sent whatever reply applies (when the protocol got far enough to know
+// one), and the caller is expected to close it.
+func socks5Handshake(conn net.Conn, acl *ACL) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("reading version header: %v", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("reading auth methods: %v", err)
+	}
+	supportsNoAuth := false
+	for _, m := range methods {
+		if m == socks5MethodNoAuth {
+			supportsNoAuth = true
+			break
+		}
+	}
+	if !supportsNoAuth {
+		conn.Write([]byte{socks5Version, socks5MethodUnacceptable})
+		return "", fmt.Errorf("client does not offer the no-auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth}); err != nil {
+		return "", fmt.Errorf("writing method selection: %v", err)
+	}
+
+	reqHeader := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reqHeader); err != nil {
+		return "", fmt.Errorf("reading request header: %v", err)
+	}
+	if reqHeader[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d in request", reqHeader[0])
+	}
+	if reqHeader[1] != socks5CmdConnect {
+		writeSocks5Reply(conn, socks5ReplyCmdNotSupported)
+		return "", fmt.Errorf("unsupported socks5 command %d", reqHeader[1])
+	}
+
+	var host string
+	switch reqHeader[3] {
+	case socks5AtypIPv4:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", fmt.Errorf("reading ipv4 address: %v", err)
+		}
+		host = net.IP(addr).String()
+	case socks5AtypDomain:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return "", fmt.Errorf("reading domain length: %v", err)
+		}
+		domain := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("reading domain: %v", err)
+		}
+		host = string(domain)
+	case socks5AtypIPv6:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", fmt.Errorf("reading ipv6 address: %v", err)
+		}
+		host = net.IP(addr).String()
+	default:
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure)
+		return "", fmt.Errorf("unsupported socks5 address type %d", reqHeader[3])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return "", fmt.Errorf("reading port: %v", err)
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBuf))))
+
+	if acl != nil && !acl.Allowed(target) {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed)
+		return "", fmt.Errorf("target %s denied by ACL", target)
+	}
+
+	if err := writeSocks5Reply(conn, socks5ReplySuccess); err != nil {
+		return "", fmt.Errorf("writing reply: %v", err)
+	}
+	return target, nil
+}
+
+// writeSocks5Reply writes a minimal SOCKS5 reply carrying rep. The bound
+// address is always reported as 0.0.0.0:0: chicha-tcp-proxy does not keep
+// a separate outbound socket per reply to report a real one, and SOCKS5
+// clients do not rely on it once the CONNECT has succeeded.
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	reply := []byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	_, err := conn.Write(reply)
+	return err
+}
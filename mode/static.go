@@ -0,0 +1,42 @@
+package mode
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// Static is the original proxy mode: every connection accepted on
+// ListenAddr is forwarded to the same fixed TargetAddr, as configured by
+// -routes. It is the default mode and the one every other mode was
+// refactored out of.
+type Static struct {
+	ListenAddr string
+	TargetAddr string
+	Logger     *clog.Logger
+
+	// ShutdownTimeout bounds how long a connection is given to finish on
+	// its own after ctx is cancelled before it is force-closed.
+	ShutdownTimeout time.Duration
+
+	// Limiter, if non-nil, bounds concurrent connections and reports
+	// metrics for this route.
+	Limiter *Limiter
+}
+
+// Run listens on s.ListenAddr and forwards every connection to s.TargetAddr
+// until ctx is cancelled.
+func (s *Static) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start proxy on %s: %v", s.ListenAddr, err)
+	}
+	s.Logger.Infof("proxy started", clog.F("listen_addr", s.ListenAddr), clog.F("target", s.TargetAddr))
+
+	return serve(ctx, listener, s.Logger, func(ctx context.Context, conn net.Conn) {
+		ForwardConn(ctx, s.Logger, conn, s.TargetAddr, s.ShutdownTimeout, s.Limiter)
+	})
+}
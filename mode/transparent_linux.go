@@ -0,0 +1,95 @@
+//go:build linux
+
+package mode
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h. The syscall
+// package does not expose it, and its value is the same across every Linux
+// architecture, so it is simplest to hard-code here.
+const soOriginalDst = 80
+
+// Transparent is a Mode for boxes running behind an iptables REDIRECT rule:
+// instead of being told the target up front, it recovers each connection's
+// pre-DNAT destination via SO_ORIGINAL_DST, so the proxy can be dropped in
+// without a route table of its own.
+type Transparent struct {
+	ListenAddr string
+	Logger     *clog.Logger
+
+	// ShutdownTimeout bounds how long a connection is given to finish on
+	// its own after ctx is cancelled before it is force-closed.
+	ShutdownTimeout time.Duration
+
+	// Limiter, if non-nil, bounds concurrent connections and reports
+	// metrics for this route.
+	Limiter *Limiter
+}
+
+// NewTransparent builds a Transparent mode listening on listenAddr.
+func NewTransparent(listenAddr string, logger *clog.Logger, shutdownTimeout time.Duration, limiter *Limiter) Mode {
+	return &Transparent{ListenAddr: listenAddr, Logger: logger, ShutdownTimeout: shutdownTimeout, Limiter: limiter}
+}
+
+// Run listens on t.ListenAddr and forwards every connection to its
+// recovered original destination until ctx is cancelled.
+func (t *Transparent) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", t.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start transparent proxy on %s: %v", t.ListenAddr, err)
+	}
+	t.Logger.Infof("transparent proxy started", clog.F("listen_addr", t.ListenAddr))
+
+	return serve(ctx, listener, t.Logger, func(ctx context.Context, conn net.Conn) {
+		target, err := originalDst(conn)
+		if err != nil {
+			t.Logger.Warnf("failed to recover original destination", t.Logger.ClientAddrField(conn.RemoteAddr().String()), clog.F("error", err))
+			conn.Close()
+			return
+		}
+		ForwardConn(ctx, t.Logger, conn, target, t.ShutdownTimeout, t.Limiter)
+	})
+}
+
+// originalDst reads conn's pre-DNAT destination address via
+// SO_ORIGINAL_DST, the standard way to recover it behind an iptables
+// REDIRECT rule. It reuses syscall.GetsockoptIPv6Mreq purely because that
+// call happens to read back the same 16 raw bytes a struct sockaddr_in
+// occupies, a well-known trick for reading this option without a cgo
+// dependency on <linux/netfilter_ipv4.h>.
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("connection is not a *net.TCPConn")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", fmt.Errorf("getting raw connection: %v", err)
+	}
+
+	var mreq *syscall.IPv6Mreq
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+	}); err != nil {
+		return "", fmt.Errorf("control: %v", err)
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %v", sockErr)
+	}
+
+	// struct sockaddr_in is: 2 bytes family, 2 bytes port (big-endian),
+	// 4 bytes IPv4 address.
+	raw16 := mreq.Multiaddr
+	port := int(raw16[2])<<8 | int(raw16[3])
+	ip := net.IPv4(raw16[4], raw16[5], raw16[6], raw16[7])
+	return fmt.Sprintf("%s:%d", ip.String(), port), nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package mode
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// Transparent stands in for non-Linux builds: SO_ORIGINAL_DST is a Linux
+// netfilter feature, so transparent mode cannot work anywhere else.
+type Transparent struct{}
+
+// NewTransparent returns a Mode whose Run always fails, since transparent
+// mode needs SO_ORIGINAL_DST, which only exists on Linux.
+func NewTransparent(listenAddr string, logger *clog.Logger, shutdownTimeout time.Duration, limiter *Limiter) Mode {
+	return &Transparent{}
+}
+
+// Run always fails on non-Linux platforms.
+func (t *Transparent) Run(ctx context.Context) error {
+	return fmt.Errorf("transparent mode requires Linux (SO_ORIGINAL_DST is not available on this platform)")
+}
@@ -0,0 +1,234 @@
+package mode
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// udpPacketBufferSize is large enough for any UDP datagram; the largest
+// possible is 65507 bytes of payload.
+const udpPacketBufferSize = 65536
+
+// UDP is a Mode for a "udp/" route: it forwards datagrams between clients
+// and a fixed target, modeled on slirpnetstack's LocalForwardUDP. Since UDP
+// has no connection to accept, a "flow" here is NAT-style bookkeeping: the
+// first packet from a client address opens an upstream socket dialed to
+// TargetAddr, and every later packet from that same client address reuses
+// it until IdleTimeout passes with no traffic either way.
+type UDP struct {
+	ListenAddr string
+	TargetAddr string
+
+	// IdleTimeout closes a flow's upstream socket once this long has
+	// passed without a packet in either direction.
+	IdleTimeout time.Duration
+
+	Logger *clog.Logger
+
+	// Limiter, if non-nil, bounds concurrent flows and reports metrics
+	// for this route.
+	Limiter *Limiter
+}
+
+// Run listens on u.ListenAddr and forwards every flow to u.TargetAddr until
+// ctx is cancelled, at which point it closes every open flow and returns
+// once they have all finished.
+func (u *UDP) Run(ctx context.Context) error {
+	listenAddr, err := net.ResolveUDPAddr("udp", u.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp listen address %s: %v", u.ListenAddr, err)
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", u.TargetAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp target address %s: %v", u.TargetAddr, err)
+	}
+
+	listener, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start udp proxy on %s: %v", u.ListenAddr, err)
+	}
+	defer listener.Close()
+	u.Logger.Infof("udp proxy started", clog.F("listen_addr", u.ListenAddr), clog.F("target", u.TargetAddr))
+
+	// Closing the listener is what unblocks ReadFromUDP once ctx is
+	// cancelled.
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var mu sync.Mutex // guards flows, touched by this loop and by flow expiry/shutdown
+	flows := make(map[string]*udpFlow)
+	var wg sync.WaitGroup // tracks open flows so Run only returns once they are all closed
+
+	buf := make([]byte, udpPacketBufferSize)
+	for {
+		n, clientAddr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				return nil
+			default:
+			}
+			u.Logger.Warnf("error reading udp packet", clog.F("listen_addr", u.ListenAddr), clog.F("error", err))
+			continue
+		}
+
+		key := clientAddr.String()
+		mu.Lock()
+		flow, ok := flows[key]
+		if !ok {
+			if !u.Limiter.acquire() {
+				mu.Unlock()
+				u.Logger.Warnf("udp flow rejected: limit reached", u.Logger.ClientAddrField(clientAddr.String()))
+				continue
+			}
+			flow, err = newUDPFlow(ctx, u.Logger, listener, clientAddr, targetAddr, u.IdleTimeout, u.Limiter, &wg, func() {
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			})
+			if err != nil {
+				mu.Unlock()
+				u.Limiter.dialError()
+				u.Limiter.release()
+				u.Logger.Warnf("failed to open udp flow", u.Logger.ClientAddrField(clientAddr.String()), clog.F("error", err))
+				continue
+			}
+			flows[key] = flow
+		}
+		mu.Unlock()
+
+		// ReadFromUDP reuses buf on the next call, so the flow needs its
+		// own copy of this packet before Run loops back around.
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		flow.send(data)
+	}
+}
+
+// udpFlow is one client's NAT-style session: a dedicated upstream socket
+// dialed to the target, an idle timer, and byte counters for both
+// directions.
+type udpFlow struct {
+	clientAddr *net.UDPAddr
+	upstream   *net.UDPConn
+	logger     *clog.Logger
+	start      time.Time
+
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	bytesUp   int64 // atomic
+	bytesDown int64 // atomic
+
+	limiter   *Limiter
+	wg        *sync.WaitGroup
+	onClose   func()
+	closeOnce sync.Once
+	finished  chan struct{} // closed once, by close(), so the shutdown watcher can stop waiting
+}
+
+// newUDPFlow dials a fresh upstream socket to targetAddr, registers it with
+// wg, and starts the goroutine that copies replies back to clientAddr via
+// listener. onClose is called exactly once, after the flow has closed, so
+// the caller can remove it from its flow table. The caller must already
+// have acquired limiter for this flow; newUDPFlow releases it on close.
+func newUDPFlow(ctx context.Context, logger *clog.Logger, listener *net.UDPConn, clientAddr, targetAddr *net.UDPAddr, idleTimeout time.Duration, limiter *Limiter, wg *sync.WaitGroup, onClose func()) (*udpFlow, error) {
+	// A fresh local socket per flow, dialed straight at the target, is the
+	// MagicDialUDP-style "connected" UDP session: reads from it only ever
+	// see replies from targetAddr.
+	upstream, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing upstream: %v", err)
+	}
+
+	connID := clog.NextConnID()
+	flowLogger := logger.With(clog.F("conn_id", connID), logger.ClientAddrField(clientAddr.String()))
+	flowLogger.Infof("new udp flow", clog.F("target", targetAddr.String()))
+
+	f := &udpFlow{
+		clientAddr:  clientAddr,
+		upstream:    upstream,
+		logger:      flowLogger,
+		start:       time.Now(),
+		idleTimeout: idleTimeout,
+		limiter:     limiter,
+		wg:          wg,
+		onClose:     onClose,
+		finished:    make(chan struct{}),
+	}
+	wg.Add(1)
+	f.idleTimer = time.AfterFunc(idleTimeout, func() { f.close("idle timeout") })
+
+	go f.readLoop(listener, targetAddr)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.close("shutdown")
+		case <-f.finished:
+		}
+	}()
+
+	return f, nil
+}
+
+// send writes data to the flow's upstream socket and resets its idle
+// timer, since outbound traffic keeps the flow alive just like a reply
+// does.
+func (f *udpFlow) send(data []byte) {
+	n, err := f.upstream.Write(data)
+	if err != nil {
+		f.logger.Warnf("error writing to upstream", clog.F("error", err))
+		return
+	}
+	atomic.AddInt64(&f.bytesUp, int64(n))
+	f.idleTimer.Reset(f.idleTimeout)
+}
+
+// readLoop copies replies from the flow's upstream socket back to the
+// client via listener, until the upstream socket is closed (by expiry or
+// shutdown).
+func (f *udpFlow) readLoop(listener *net.UDPConn, targetAddr *net.UDPAddr) {
+	buf := make([]byte, udpPacketBufferSize)
+	for {
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			f.close("upstream closed")
+			return
+		}
+		atomic.AddInt64(&f.bytesDown, int64(n))
+		f.idleTimer.Reset(f.idleTimeout)
+		if _, err := listener.WriteToUDP(buf[:n], f.clientAddr); err != nil {
+			f.logger.Warnf("error writing to client", clog.F("error", err))
+		}
+	}
+}
+
+// close tears the flow down exactly once, logging its totals the same way
+// ForwardConn logs a closed TCP connection.
+func (f *udpFlow) close(reason string) {
+	f.closeOnce.Do(func() {
+		f.idleTimer.Stop()
+		f.upstream.Close()
+		bytesUp := atomic.LoadInt64(&f.bytesUp)
+		bytesDown := atomic.LoadInt64(&f.bytesDown)
+		f.logger.Infof("udp flow closed",
+			clog.F("reason", reason),
+			clog.F("bytes_up", bytesUp),
+			clog.F("bytes_down", bytesDown),
+			clog.F("duration", time.Since(f.start)))
+		f.limiter.addBytes(bytesUp, bytesDown)
+		f.limiter.release()
+		f.onClose()
+		f.wg.Done()
+		close(f.finished)
+	})
+}
@@ -0,0 +1,143 @@
+package mode
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	clog "github.com/matveynator/chicha-tcp-proxy/common/log"
+)
+
+// newUDPEchoServer starts a UDP socket that echoes every datagram back to
+// whoever sent it, for use as a flow's target.
+func newUDPEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, udpPacketBufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPFlowOpenSendCloseCycle(t *testing.T) {
+	targetAddr := newUDPEchoServer(t)
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	logger := clog.New(io.Discard, clog.LevelError)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var onCloseCalls int
+	var mu sync.Mutex
+	onClose := func() {
+		mu.Lock()
+		onCloseCalls++
+		mu.Unlock()
+	}
+
+	flow, err := newUDPFlow(ctx, logger, listener, clientAddr, targetAddr, time.Minute, nil, &wg, onClose)
+	if err != nil {
+		t.Fatalf("newUDPFlow: %v", err)
+	}
+
+	flow.send([]byte("ping"))
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, udpPacketBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("client did not receive echoed reply: %v", err)
+	}
+	if got := string(buf[:n]); got != "ping" {
+		t.Fatalf("echoed reply = %q, want %q", got, "ping")
+	}
+
+	// close is idempotent: concurrent callers must only trigger onClose
+	// and wg.Done once between them.
+	var closers sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			flow.close("test")
+		}()
+	}
+	closers.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wg.Wait did not return after flow closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if onCloseCalls != 1 {
+		t.Fatalf("onClose called %d times, want 1", onCloseCalls)
+	}
+}
+
+func TestUDPFlowIdleTimeout(t *testing.T) {
+	targetAddr := newUDPEchoServer(t)
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer listener.Close()
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	logger := clog.New(io.Discard, clog.LevelError)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	closed := make(chan struct{})
+	onClose := func() { close(closed) }
+
+	flow, err := newUDPFlow(ctx, logger, listener, clientAddr, targetAddr, 20*time.Millisecond, nil, &wg, onClose)
+	if err != nil {
+		t.Fatalf("newUDPFlow: %v", err)
+	}
+	flow.send([]byte("ping"))
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("flow did not close on idle timeout")
+	}
+}